@@ -0,0 +1,634 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package service implements the Teleport service lifecycle: parsing,
+// validating and applying the configuration for each of the roles a
+// Teleport process can run (auth, SSH, proxy, app access, database
+// access, ...).
+package service
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/backend/lite"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/srv/app/common"
+	"github.com/gravitational/teleport/lib/tlsca"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config structures configure the Teleport process. The outer Config
+// aggregates the configuration of every service (auth, SSH, proxy, ...)
+// that a single `teleport` binary can run.
+type Config struct {
+	// DataDir is the directory where teleport stores its local database.
+	DataDir string
+	// Hostname is the host's name.
+	Hostname string
+
+	// CipherSuites is a list of TLS ciphersuites that Teleport supports.
+	CipherSuites []uint16
+	// Ciphers is a list of SSH ciphers that the server supports.
+	Ciphers []string
+	// KEXAlgorithms is a list of SSH key exchange (KEX) algorithms that the
+	// server supports.
+	KEXAlgorithms []string
+	// MACAlgorithms is a list of SSH message authentication codes (MAC)
+	// that the server supports.
+	MACAlgorithms []string
+	// CASignatureAlgorithm is an SSH CA signature algorithm to use.
+	CASignatureAlgorithm *string
+
+	// RotationConnectionInterval is the interval between connection
+	// attempts as used by the rotation state service.
+	RotationConnectionInterval time.Duration
+	// RestartThreshold describes the amount of connection errors within
+	// a given time period that are allowed before a restart is triggered.
+	RestartThreshold ConnectionErrorThreshold
+
+	Auth  AuthConfig
+	SSH   SSHConfig
+	Proxy ProxyConfig
+}
+
+// ConnectionErrorThreshold describes a number of connection errors
+// allowed in a given time window before a service gives up and restarts.
+type ConnectionErrorThreshold struct {
+	// Amount is the number of errors to tolerate.
+	Amount int64
+	// Time is the window over which errors are counted.
+	Time time.Duration
+}
+
+// AuthConfig configures the auth service.
+type AuthConfig struct {
+	Enabled bool
+	SSHAddr utils.NetAddr
+	Limiter limiter.Config
+
+	// StorageConfig is the backend storage configuration for the auth
+	// server.
+	StorageConfig backend.Config
+}
+
+// SSHConfig configures the SSH (node) service.
+type SSHConfig struct {
+	Enabled bool
+	Limiter limiter.Config
+	// AllowTCPForwarding enables port forwarding for SSH sessions.
+	AllowTCPForwarding bool
+}
+
+// ProxyConfig configures the proxy service.
+type ProxyConfig struct {
+	Enabled bool
+	Limiter limiter.Config
+}
+
+// MakeDefaultConfig creates a new Config structure populated by defaults.
+func MakeDefaultConfig() *Config {
+	cfg := &Config{}
+	ApplyDefaults(cfg)
+	return cfg
+}
+
+// ApplyDefaults applies default values to the existing config structure.
+func ApplyDefaults(cfg *Config) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+		log.Errorf("Failed to determine hostname: %v.", err)
+	}
+
+	cfg.Hostname = hostname
+	cfg.DataDir = defaults.DataDir
+	cfg.CipherSuites = utils.DefaultCipherSuites()
+	cfg.Ciphers = defaults.CiphersSSH
+	cfg.KEXAlgorithms = defaults.KEXAlgorithmsSSH
+	cfg.MACAlgorithms = defaults.MACAlgorithmsSSH
+
+	cfg.RotationConnectionInterval = defaults.HighResPollingPeriod
+	cfg.RestartThreshold = ConnectionErrorThreshold{
+		Amount: defaults.MaxConnectionErrorsBeforeRestart,
+		Time:   defaults.ConnectionErrorMeasurementPeriod,
+	}
+
+	cfg.Auth.Enabled = true
+	cfg.Auth.SSHAddr = utils.NetAddr{AddrNetwork: "tcp", Addr: defaults.AuthListenAddr}
+	cfg.Auth.Limiter.MaxConnections = defaults.LimiterMaxConnections
+	cfg.Auth.Limiter.MaxNumberOfUsers = defaults.LimiterMaxConcurrentUsers
+	cfg.Auth.StorageConfig.Type = lite.GetName()
+	cfg.Auth.StorageConfig.Params = backend.Params{
+		defaults.BackendPath: filepath.Join(cfg.DataDir, defaults.BackendDir),
+	}
+
+	cfg.SSH.Enabled = true
+	cfg.SSH.Limiter.MaxConnections = defaults.LimiterMaxConnections
+	cfg.SSH.Limiter.MaxNumberOfUsers = defaults.LimiterMaxConcurrentUsers
+	cfg.SSH.AllowTCPForwarding = true
+
+	cfg.Proxy.Enabled = true
+	cfg.Proxy.Limiter.MaxConnections = defaults.LimiterMaxConnections
+	cfg.Proxy.Limiter.MaxNumberOfUsers = defaults.LimiterMaxConcurrentUsers
+}
+
+// Header represents a single HTTP header passed over to the application
+// or used to rewrite an HTTP response.
+type Header struct {
+	// Name is the header name.
+	Name string
+	// Value is the header value.
+	Value string
+}
+
+// String returns the Header as a formatted "name: value" string.
+func (h Header) String() string {
+	return fmt.Sprintf("%s: %s", h.Name, h.Value)
+}
+
+// ParseHeader parses a single "name: value" header.
+func ParseHeader(header string) (*Header, error) {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 {
+		return nil, trace.BadParameter("failed to parse %q as http header", header)
+	}
+	name := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
+	if !httpGuid.MatchString(name) {
+		return nil, trace.BadParameter("invalid http header name: %q", header)
+	}
+	return &Header{Name: name, Value: value}, nil
+}
+
+// httpGuid is a conservative pattern matching valid HTTP header names.
+var httpGuid = regexp.MustCompile(`^[\w-]+$`)
+
+// ParseHeaders parses a list of "name: value" formatted strings into a
+// list of http headers.
+func ParseHeaders(headers []string) (headersOut []Header, err error) {
+	for _, header := range headers {
+		h, err := ParseHeader(header)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		headersOut = append(headersOut, *h)
+	}
+	return headersOut, nil
+}
+
+// Rewrite is a list of rewriting rules to apply to requests and
+// responses of an application.
+type Rewrite struct {
+	// Redirect is a list of hosts that should be rewritten to the public
+	// address of the application.
+	Redirect []string
+	// Headers is a list of extra headers to inject in the request.
+	Headers []Header
+}
+
+// App is the configuration for an application to be proxied.
+type App struct {
+	// Name of the application.
+	Name string
+	// URI is the address the application is available at.
+	URI string
+	// PublicAddr is the public address the application is accessible at.
+	PublicAddr string
+	// Rewrite is a list of rewriting rules to apply to requests and
+	// responses.
+	Rewrite *Rewrite
+	// JWT configures signing and injection of a per-request identity JWT.
+	JWT *AppJWT
+}
+
+// AppJWT configures Teleport's JWT rewrite mode for an application: on
+// every proxied request, Teleport mints a short-lived signed JWT
+// asserting the caller's identity and injects it as a request header so
+// the upstream application can verify the caller without implementing
+// its own auth.
+type AppJWT struct {
+	// Audience is the `aud` claim of the minted JWT. Defaults to the
+	// application's PublicAddr.
+	Audience string
+	// Header is the name of the header the JWT is injected into.
+	// Defaults to "Teleport-Jwt-Assertion".
+	Header string
+	// Claims restricts which traits are included in the `traits` claim.
+	Claims AppJWTClaims
+	// RolloverPeriod is the lifetime of each minted JWT: its expiry is
+	// set this far after the request it was minted for. Defaults to
+	// defaults.RotationGracePeriod.
+	RolloverPeriod time.Duration
+}
+
+// AppJWTClaims is an allow/deny list of trait names to include in the
+// `traits` claim of a minted JWT.
+type AppJWTClaims struct {
+	// Allow is the list of trait names to include. If empty, all of the
+	// caller's traits are included.
+	Allow []string
+	// Deny is the list of trait names to exclude, applied after Allow.
+	Deny []string
+}
+
+// defaultJWTHeader is the header Teleport injects the signed JWT
+// assertion into when App.JWT.Header isn't set.
+const defaultJWTHeader = "Teleport-Jwt-Assertion"
+
+// knownTraitNames are the trait names Teleport itself populates on a
+// user's identity and that can therefore be safely referenced by
+// App.JWT.Claims.
+var knownTraitNames = map[string]bool{
+	teleport.TraitLogins:        true,
+	teleport.TraitKubeGroups:    true,
+	teleport.TraitKubeUsers:     true,
+	teleport.TraitDBNames:       true,
+	teleport.TraitDBUsers:       true,
+	teleport.TraitAWSRoleARNs:   true,
+	teleport.TraitWindowsLogins: true,
+}
+
+// subdomainRegexp validates that an application name can be safely used
+// as a DNS subdomain.
+var subdomainRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// CheckAndSetDefaults validates the app and sets defaults.
+func (a *App) CheckAndSetDefaults() error {
+	if a.Name == "" {
+		return trace.BadParameter("missing application %q name", a.URI)
+	}
+	if len(a.Name) > 63 || !subdomainRegexp.MatchString(a.Name) {
+		return trace.BadParameter("application %q name must be a valid DNS subdomain: https://goteleport.com/docs/application-access/guides/connecting-apps/#application-name", a.Name)
+	}
+	if a.URI == "" {
+		return trace.BadParameter("application %q URI is empty", a.Name)
+	}
+	if a.Rewrite != nil {
+		for _, header := range a.Rewrite.Headers {
+			if common.IsReservedHeader(header.Name) {
+				return trace.BadParameter("invalid application %q header rewrite configuration: header %q is reserved and can't be rewritten", a.Name, header.Name)
+			}
+		}
+	}
+	if a.JWT != nil {
+		if err := a.JWT.CheckAndSetDefaults(a.Name, a.PublicAddr); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// CheckAndSetDefaults validates the JWT rewrite configuration and sets
+// defaults.
+func (j *AppJWT) CheckAndSetDefaults(appName, publicAddr string) error {
+	if j.Header == "" {
+		j.Header = defaultJWTHeader
+	}
+	if common.IsReservedHeader(j.Header) {
+		return trace.BadParameter("invalid application %q JWT rewrite configuration: header %q is reserved and can't be used for the JWT assertion", appName, j.Header)
+	}
+	if j.Audience == "" {
+		j.Audience = publicAddr
+	}
+	if j.RolloverPeriod == 0 {
+		j.RolloverPeriod = defaults.RotationGracePeriod
+	}
+	for _, name := range append(append([]string{}, j.Claims.Allow...), j.Claims.Deny...) {
+		if !knownTraitNames[name] {
+			return trace.BadParameter("invalid application %q JWT rewrite configuration: unknown trait name %q", appName, name)
+		}
+	}
+	return nil
+}
+
+// DatabaseTLS keeps TLS settings used when connecting to a database.
+type DatabaseTLS struct {
+	// CACert is the PEM-encoded database CA certificate.
+	CACert []byte
+}
+
+// DatabaseGCP contains GCP-specific settings for Cloud SQL databases.
+type DatabaseGCP struct {
+	// ProjectID is the GCP project ID.
+	ProjectID string
+	// InstanceID is the Cloud SQL instance ID.
+	InstanceID string
+}
+
+// DatabaseAD contains Active Directory authentication settings used for
+// SQL Server Kerberos auth.
+type DatabaseAD struct {
+	// KeytabFile is the path to the Kerberos keytab file.
+	KeytabFile string
+	// Domain is the Active Directory domain name.
+	Domain string
+	// SPN is the service principal name for the database.
+	SPN string
+}
+
+// DatabaseCassandra contains Cassandra-specific settings.
+type DatabaseCassandra struct {
+	// Datacenter is the name of the target Cassandra datacenter.
+	Datacenter string
+	// Keyspace is the default keyspace to use for the session.
+	Keyspace string
+}
+
+// DatabaseAzure contains Azure-specific settings for CosmosDB databases.
+type DatabaseAzure struct {
+	// SubscriptionID is the Azure subscription ID the account belongs to.
+	SubscriptionID string
+	// ResourceGroup is the Azure resource group the account belongs to.
+	ResourceGroup string
+	// CosmosDB contains CosmosDB-specific settings.
+	CosmosDB DatabaseCosmosDB
+}
+
+// DatabaseCosmosDB contains settings specific to an Azure CosmosDB (SQL
+// API) account.
+type DatabaseCosmosDB struct {
+	// AccountName is the name of the CosmosDB account.
+	AccountName string
+}
+
+// Database represents a single database proxied by the database service.
+type Database struct {
+	// Name is the name of the database proxy.
+	Name string
+	// Protocol is the database protocol: postgres, mysql, mongodb, etc.
+	Protocol string
+	// URI is the database connection endpoint.
+	URI string
+	// GCP contains GCP-specific Cloud SQL settings.
+	GCP DatabaseGCP
+	// AD contains Active Directory settings for SQL Server.
+	AD DatabaseAD
+	// Cassandra contains Cassandra-specific settings.
+	Cassandra DatabaseCassandra
+	// Azure contains Azure-specific settings for CosmosDB.
+	Azure DatabaseAzure
+	// TLS keeps database connection TLS config.
+	TLS DatabaseTLS
+}
+
+// databaseNameRegexp validates database resource names.
+var databaseNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// CheckAndSetDefaults validates the database and sets defaults.
+func (d *Database) CheckAndSetDefaults() error {
+	if d.Name == "" {
+		return trace.BadParameter("empty database name")
+	}
+	if !databaseNameRegexp.MatchString(d.Name) {
+		return trace.BadParameter("invalid database %q name: names must consist of letters, digits, dashes, dots and underscores", d.Name)
+	}
+
+	switch d.Protocol {
+	case defaults.ProtocolPostgres, defaults.ProtocolMySQL, defaults.ProtocolMongoDB,
+		defaults.ProtocolSQLServer, defaults.ProtocolCassandra, defaults.ProtocolCosmosDB:
+	default:
+		return trace.BadParameter("unsupported database %q protocol %q", d.Name, d.Protocol)
+	}
+
+	switch d.Protocol {
+	case defaults.ProtocolMongoDB:
+		if err := checkMongoDBURI(d.URI); err != nil {
+			return trace.Wrap(err)
+		}
+	case defaults.ProtocolCassandra:
+		if err := checkCassandraURI(d.URI); err != nil {
+			return trace.Wrap(err)
+		}
+	case defaults.ProtocolCosmosDB:
+		if !strings.HasPrefix(d.URI, "https://") {
+			return trace.BadParameter("invalid CosmosDB database %q URI %q: must be an https endpoint", d.Name, d.URI)
+		}
+	default:
+		if _, _, err := net.SplitHostPort(d.URI); err != nil {
+			return trace.BadParameter("invalid database %q URI %q: %v", d.Name, d.URI, err)
+		}
+	}
+
+	if len(d.TLS.CACert) != 0 {
+		if _, err := tlsca.ParseCertificatePEM(d.TLS.CACert); err != nil {
+			return trace.BadParameter("provided database %q CA certificate is invalid: %v", d.Name, err)
+		}
+	}
+
+	if (d.GCP.ProjectID != "") != (d.GCP.InstanceID != "") {
+		return trace.BadParameter("both GCP project ID and instance ID must be set for database %q", d.Name)
+	}
+
+	if d.AD.KeytabFile != "" || d.AD.Domain != "" || d.AD.SPN != "" {
+		if d.Protocol != defaults.ProtocolSQLServer {
+			return trace.BadParameter("Active Directory configuration is only supported for SQL Server databases, got %q", d.Protocol)
+		}
+		if d.AD.KeytabFile == "" {
+			return trace.BadParameter("missing keytab file path for database %q", d.Name)
+		}
+		if d.AD.Domain == "" {
+			return trace.BadParameter("missing Active Directory domain for database %q", d.Name)
+		}
+		if d.AD.SPN == "" {
+			return trace.BadParameter("missing service principal name for database %q", d.Name)
+		}
+	}
+
+	if d.Cassandra != (DatabaseCassandra{}) && d.Protocol != defaults.ProtocolCassandra {
+		return trace.BadParameter("Cassandra configuration is only supported for Cassandra databases, got %q", d.Protocol)
+	}
+
+	if d.Azure != (DatabaseAzure{}) {
+		if d.Protocol != defaults.ProtocolCosmosDB {
+			return trace.BadParameter("Azure configuration is only supported for CosmosDB databases, got %q", d.Protocol)
+		}
+		if d.Azure.SubscriptionID == "" {
+			return trace.BadParameter("missing Azure subscription ID for database %q", d.Name)
+		}
+		if d.Azure.ResourceGroup == "" {
+			return trace.BadParameter("missing Azure resource group for database %q", d.Name)
+		}
+		if d.Azure.CosmosDB.AccountName == "" {
+			return trace.BadParameter("missing Azure CosmosDB account name for database %q", d.Name)
+		}
+	}
+
+	if requiresTLSWireProtocol(d.Protocol, d.URI) && len(d.TLS.CACert) == 0 {
+		return trace.BadParameter("database %q requires a CA certificate to be set since its connection is encrypted", d.Name)
+	}
+
+	return nil
+}
+
+// checkMongoDBURI validates that uri is a well-formed MongoDB connection
+// string.
+func checkMongoDBURI(uri string) error {
+	if !strings.HasPrefix(uri, "mongodb://") && !strings.HasPrefix(uri, "mongodb+srv://") {
+		return trace.BadParameter("invalid MongoDB connection string %q", uri)
+	}
+	return nil
+}
+
+// cassandraURIScheme is the optional scheme prefix indicating the
+// Cassandra connection should use native protocol TLS.
+const cassandraURIScheme = "cassandras://"
+
+// checkCassandraURI validates a Cassandra "contact points + port" URI,
+// e.g. "host1:9042,host2:9042", with an optional "cassandras://" TLS
+// scheme prefix.
+func checkCassandraURI(uri string) error {
+	uri = strings.TrimPrefix(uri, cassandraURIScheme)
+	if uri == "" {
+		return trace.BadParameter("empty Cassandra contact points")
+	}
+	for _, contactPoint := range strings.Split(uri, ",") {
+		if _, _, err := net.SplitHostPort(contactPoint); err != nil {
+			return trace.BadParameter("invalid Cassandra contact point %q: %v", contactPoint, err)
+		}
+	}
+	return nil
+}
+
+// requiresTLSWireProtocol returns true if the given protocol/URI
+// combination implies the database requires a TLS-wrapped connection and
+// thus a CA certificate.
+func requiresTLSWireProtocol(protocol, uri string) bool {
+	if protocol != defaults.ProtocolCassandra {
+		return false
+	}
+	return strings.HasPrefix(uri, cassandraURIScheme)
+}
+
+// HostLabelRule describes a rule for applying labels to a matching host.
+// Label values may reference the matching Regexp's capture groups via
+// "$1" or "${name}", as well as the "{{hostname}}" and "{{fqdn_suffix}}"
+// template variables.
+type HostLabelRule struct {
+	// Regexp is the pattern to match hostnames against.
+	Regexp *regexp.Regexp
+	// Labels are the labels to apply to matching hosts.
+	Labels map[string]string
+}
+
+// HostLabelRules is a collection of HostLabelRule.
+type HostLabelRules []HostLabelRule
+
+// CheckAndSetDefaults validates that every capture group a label value
+// references, whether by name ("${name}") or by number ("$1", "${1}"),
+// actually exists in its rule's Regexp, so misconfiguration is caught
+// at config-load time rather than silently producing empty label
+// values at runtime.
+func (h HostLabelRules) CheckAndSetDefaults() error {
+	for _, rule := range h {
+		groupNames := make(map[string]bool)
+		for _, name := range rule.Regexp.SubexpNames() {
+			if name != "" {
+				groupNames[name] = true
+			}
+		}
+		numGroups := rule.Regexp.NumSubexp()
+
+		for label, value := range rule.Labels {
+			for _, m := range groupRefs.FindAllStringSubmatch(value, -1) {
+				ref := m[1]
+				if ref == "" {
+					ref = m[2]
+				}
+				if numericRef.MatchString(ref) {
+					idx, err := strconv.Atoi(ref)
+					if err != nil || idx == 0 || idx > numGroups {
+						return trace.BadParameter(
+							"host label rule %q references undefined capture group %q in label %q",
+							rule.Regexp.String(), ref, label)
+					}
+					continue
+				}
+				if !groupNames[ref] {
+					return trace.BadParameter(
+						"host label rule %q references undefined capture group %q in label %q",
+						rule.Regexp.String(), ref, label)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// groupRefs matches "$1"/"${1}" (numbered) and "${name}" (named)
+// capture group references in a label template.
+var groupRefs = regexp.MustCompile(`\$(?:\{(\w+)\}|(\d+))`)
+
+// numericRef matches a purely numeric capture group reference, e.g.
+// the "1" in "$1" or "${1}".
+var numericRef = regexp.MustCompile(`^\d+$`)
+
+// hostnameTemplate and fqdnSuffixTemplate are the template variables a
+// label value can reference in addition to regex capture groups.
+const (
+	hostnameTemplate   = "{{hostname}}"
+	fqdnSuffixTemplate = "{{fqdn_suffix}}"
+)
+
+// fqdnSuffix returns everything after the first "." in host, or "" if
+// host has no domain part.
+func fqdnSuffix(host string) string {
+	if i := strings.Index(host, "."); i != -1 {
+		return host[i+1:]
+	}
+	return ""
+}
+
+// expandLabelValue substitutes the {{hostname}}/{{fqdn_suffix}}
+// template variables and the regex capture groups matched against host
+// into a label value template.
+func expandLabelValue(value string, rule HostLabelRule, host string) string {
+	value = strings.ReplaceAll(value, hostnameTemplate, host)
+	value = strings.ReplaceAll(value, fqdnSuffixTemplate, fqdnSuffix(host))
+
+	match := rule.Regexp.FindStringSubmatchIndex(host)
+	if match == nil {
+		return value
+	}
+	return string(rule.Regexp.ExpandString(nil, value, host, match))
+}
+
+// LabelsForHost returns labels for a given host by evaluating each rule
+// against it, merging the result of every rule that matches. Label
+// values are expanded per expandLabelValue.
+func (h HostLabelRules) LabelsForHost(host string) map[string]string {
+	labels := make(map[string]string)
+	for _, rule := range h {
+		if rule.Regexp.MatchString(host) {
+			for k, v := range rule.Labels {
+				labels[k] = expandLabelValue(v, rule, host)
+			}
+		}
+	}
+	return labels
+}
@@ -162,6 +162,59 @@ func TestCheckApp(t *testing.T) {
 			err: `invalid application "foo" header rewrite configuration`,
 		})
 	}
+	for _, h := range common.ReservedHeaders {
+		tests = append(tests, tc{
+			desc: fmt.Sprintf("reserved header JWT rewrite %v", h),
+			inApp: App{
+				Name:       "foo",
+				URI:        "http://localhost",
+				PublicAddr: "foo.example.com",
+				JWT: &AppJWT{
+					Header: h,
+				},
+			},
+			err: "invalid application \"foo\" JWT rewrite configuration",
+		})
+	}
+	tests = append(tests,
+		tc{
+			desc: "JWT rewrite with default header",
+			inApp: App{
+				Name:       "foo",
+				URI:        "http://localhost",
+				PublicAddr: "foo.example.com",
+				JWT:        &AppJWT{},
+			},
+		},
+		tc{
+			desc: "JWT rewrite claims reference known traits",
+			inApp: App{
+				Name:       "foo",
+				URI:        "http://localhost",
+				PublicAddr: "foo.example.com",
+				JWT: &AppJWT{
+					Claims: AppJWTClaims{
+						Allow: []string{"logins", "kubernetes_groups"},
+						Deny:  []string{"db_users"},
+					},
+				},
+			},
+		},
+		tc{
+			desc: "JWT rewrite claims reference unknown trait",
+			inApp: App{
+				Name:       "foo",
+				URI:        "http://localhost",
+				PublicAddr: "foo.example.com",
+				JWT: &AppJWT{
+					Claims: AppJWTClaims{
+						Allow: []string{"not-a-real-trait"},
+					},
+				},
+			},
+			err: `unknown trait name "not-a-real-trait"`,
+		},
+	)
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
 			err := tt.inApp.CheckAndSetDefaults()
@@ -344,6 +397,138 @@ func TestCheckDatabase(t *testing.T) {
 			},
 			outErr: true,
 		},
+		{
+			desc: "Cassandra single contact point",
+			inDatabase: Database{
+				Name:     "cassandra",
+				Protocol: defaults.ProtocolCassandra,
+				URI:      "localhost:9042",
+			},
+			outErr: false,
+		},
+		{
+			desc: "Cassandra multiple contact points",
+			inDatabase: Database{
+				Name:     "cassandra",
+				Protocol: defaults.ProtocolCassandra,
+				URI:      "cassandra-1:9042,cassandra-2:9042",
+			},
+			outErr: false,
+		},
+		{
+			desc: "Cassandra with datacenter and keyspace",
+			inDatabase: Database{
+				Name:     "cassandra",
+				Protocol: defaults.ProtocolCassandra,
+				URI:      "cassandra-1:9042,cassandra-2:9042",
+				Cassandra: DatabaseCassandra{
+					Datacenter: "dc1",
+					Keyspace:   "example",
+				},
+			},
+			outErr: false,
+		},
+		{
+			desc: "Cassandra invalid contact point",
+			inDatabase: Database{
+				Name:     "cassandra",
+				Protocol: defaults.ProtocolCassandra,
+				URI:      "cassandra-1",
+			},
+			outErr: true,
+		},
+		{
+			desc: "Cassandra TLS URI without CA cert",
+			inDatabase: Database{
+				Name:     "cassandra",
+				Protocol: defaults.ProtocolCassandra,
+				URI:      "cassandras://cassandra-1:9042",
+			},
+			outErr: true,
+		},
+		{
+			desc: "Cassandra TLS URI with CA cert",
+			inDatabase: Database{
+				Name:     "cassandra",
+				Protocol: defaults.ProtocolCassandra,
+				URI:      "cassandras://cassandra-1:9042",
+				TLS: DatabaseTLS{
+					CACert: fixtures.LocalhostCert,
+				},
+			},
+			outErr: false,
+		},
+		{
+			desc: "Cassandra settings on a non-Cassandra database",
+			inDatabase: Database{
+				Name:     "example",
+				Protocol: defaults.ProtocolPostgres,
+				URI:      "localhost:5432",
+				Cassandra: DatabaseCassandra{
+					Keyspace: "example",
+				},
+			},
+			outErr: true,
+		},
+		{
+			desc: "CosmosDB valid configuration",
+			inDatabase: Database{
+				Name:     "cosmosdb",
+				Protocol: defaults.ProtocolCosmosDB,
+				URI:      "https://example.documents.azure.com:443",
+				Azure: DatabaseAzure{
+					SubscriptionID: "sub-1",
+					ResourceGroup:  "rg-1",
+					CosmosDB: DatabaseCosmosDB{
+						AccountName: "example",
+					},
+				},
+			},
+			outErr: false,
+		},
+		{
+			desc: "CosmosDB invalid URI",
+			inDatabase: Database{
+				Name:     "cosmosdb",
+				Protocol: defaults.ProtocolCosmosDB,
+				URI:      "example.documents.azure.com:443",
+				Azure: DatabaseAzure{
+					SubscriptionID: "sub-1",
+					ResourceGroup:  "rg-1",
+					CosmosDB: DatabaseCosmosDB{
+						AccountName: "example",
+					},
+				},
+			},
+			outErr: true,
+		},
+		{
+			desc: "CosmosDB missing subscription ID",
+			inDatabase: Database{
+				Name:     "cosmosdb",
+				Protocol: defaults.ProtocolCosmosDB,
+				URI:      "https://example.documents.azure.com:443",
+				Azure: DatabaseAzure{
+					ResourceGroup: "rg-1",
+					CosmosDB: DatabaseCosmosDB{
+						AccountName: "example",
+					},
+				},
+			},
+			outErr: true,
+		},
+		{
+			desc: "Azure settings on a non-CosmosDB database",
+			inDatabase: Database{
+				Name:     "example",
+				Protocol: defaults.ProtocolPostgres,
+				URI:      "localhost:5432",
+				Azure: DatabaseAzure{
+					SubscriptionID: "sub-1",
+				},
+			},
+			outErr: true,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
@@ -463,6 +648,45 @@ func TestHostLabelMatching(t *testing.T) {
 			},
 			expected: map[string]string{"test": "two"},
 		},
+		{
+			desc:      "named capture group substitution",
+			hostnames: []string{"prod-db.example.com"},
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: regexp.MustCompile(`^(?P<env>dev|prod)-db\.example\.com$`),
+					Labels: map[string]string{"env": "${env}"},
+				},
+			},
+			expected: map[string]string{"env": "prod"},
+		},
+		{
+			desc:      "numbered capture group substitution",
+			hostnames: []string{"db-east.example.com"},
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: regexp.MustCompile(`^db-(\w+)\.example\.com$`),
+					Labels: map[string]string{"region": "$1"},
+				},
+			},
+			expected: map[string]string{"region": "east"},
+		},
+		{
+			desc:      "hostname and fqdn_suffix templates",
+			hostnames: []string{"db-1.us-east.example.com"},
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: matchAllRule,
+					Labels: map[string]string{
+						"hostname":    "{{hostname}}",
+						"fqdn_suffix": "{{fqdn_suffix}}",
+					},
+				},
+			},
+			expected: map[string]string{
+				"hostname":    "db-1.us-east.example.com",
+				"fqdn_suffix": "us-east.example.com",
+			},
+		},
 	} {
 		t.Run(test.desc, func(t *testing.T) {
 			for _, host := range test.hostnames {
@@ -471,3 +695,74 @@ func TestHostLabelMatching(t *testing.T) {
 		})
 	}
 }
+
+// TestHostLabelRulesValidation verifies that rules referencing undefined
+// regex capture groups are rejected at config-load time.
+func TestHostLabelRulesValidation(t *testing.T) {
+	tests := []struct {
+		desc   string
+		rules  HostLabelRules
+		outErr bool
+	}{
+		{
+			desc: "valid named group reference",
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: regexp.MustCompile(`^(?P<env>dev|prod)-db\.example\.com$`),
+					Labels: map[string]string{"env": "${env}"},
+				},
+			},
+			outErr: false,
+		},
+		{
+			desc: "reference to undefined group",
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: regexp.MustCompile(`^(?P<env>dev|prod)-db\.example\.com$`),
+					Labels: map[string]string{"env": "${region}"},
+				},
+			},
+			outErr: true,
+		},
+		{
+			desc: "valid numbered group reference",
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: regexp.MustCompile(`^db-(\w+)\.example\.com$`),
+					Labels: map[string]string{"region": "$1"},
+				},
+			},
+			outErr: false,
+		},
+		{
+			desc: "valid numbered-with-braces group reference",
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: regexp.MustCompile(`^db-(\w+)\.example\.com$`),
+					Labels: map[string]string{"region": "${1}"},
+				},
+			},
+			outErr: false,
+		},
+		{
+			desc: "reference to undefined numbered group",
+			rules: HostLabelRules{
+				HostLabelRule{
+					Regexp: regexp.MustCompile(`^db-(\w+)\.example\.com$`),
+					Labels: map[string]string{"region": "$9"},
+				},
+			},
+			outErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			err := test.rules.CheckAndSetDefaults()
+			if test.outErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"net/http"
+
+	"github.com/gravitational/teleport/lib/auth/jwt"
+	"github.com/gravitational/teleport/lib/service"
+	"github.com/gravitational/teleport/lib/tlsca"
+
+	"github.com/gravitational/trace"
+)
+
+// jwksPath is the well-known path the app proxy serves an application's
+// JWT signing key's public JWKS from, so the upstream application can
+// validate the injected identity assertion without contacting the
+// Teleport auth server.
+const jwksPath = "/.well-known/jwks.json"
+
+// Forwarder proxies requests to an application's upstream target. When
+// the application's JWT rewrite mode (App.JWT) is configured, it also
+// injects a signed identity assertion into every proxied request and
+// serves the signing key's public JWKS at jwksPath.
+type Forwarder struct {
+	key      *jwt.Key
+	rewriter *jwtRewriter
+	next     http.Handler
+}
+
+// NewForwarder creates a Forwarder for app that delegates to next,
+// optionally injecting a JWT per app.JWT. key is the app's JWT signing
+// key; it's ignored if app.JWT is unset.
+func NewForwarder(app service.App, key *jwt.Key, next http.Handler) *Forwarder {
+	f := &Forwarder{next: next}
+	if app.JWT != nil {
+		f.key = key
+		f.rewriter = newJWTRewriter(key, *app.JWT)
+	}
+	return f
+}
+
+// ServeHTTP serves the app's JWKS endpoint, injects the configured JWT
+// assertion, and proxies the request to the upstream target.
+func (f *Forwarder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.key != nil && r.URL.Path == jwksPath {
+		jwksHandler(f.key)(w, r)
+		return
+	}
+
+	if f.rewriter != nil {
+		identity, err := identityFromRequest(r)
+		if err != nil {
+			http.Error(w, trace.UserMessage(err), http.StatusUnauthorized)
+			return
+		}
+		if err := f.rewriter.rewrite(r, identity); err != nil {
+			http.Error(w, trace.UserMessage(err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	f.next.ServeHTTP(w, r)
+}
+
+// identityFromRequest extracts the caller's Teleport identity from the
+// client certificate presented on the mTLS connection.
+func identityFromRequest(r *http.Request) (*tlsca.Identity, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, trace.AccessDenied("no client certificate presented")
+	}
+	cert := r.TLS.PeerCertificates[0]
+	identity, err := tlsca.FromSubject(cert.Subject, cert.NotAfter)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return identity, nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/teleport/lib/auth/jwt"
+	"github.com/gravitational/teleport/lib/service"
+	"github.com/gravitational/teleport/lib/tlsca"
+
+	"github.com/gravitational/trace"
+)
+
+// jwtRewriter mints a short-lived signed JWT identity assertion for each
+// proxied request and injects it as a configurable request header, per
+// an application's App.JWT rewrite configuration.
+type jwtRewriter struct {
+	// key signs the minted JWTs.
+	key *jwt.Key
+	// config is the application's JWT rewrite configuration.
+	config service.AppJWT
+}
+
+// newJWTRewriter creates a rewriter that mints JWTs with the given
+// signing key according to config.
+func newJWTRewriter(key *jwt.Key, config service.AppJWT) *jwtRewriter {
+	return &jwtRewriter{key: key, config: config}
+}
+
+// rewrite mints a JWT asserting identity's username, roles and allowed
+// traits, and sets it as the configured header on req.
+func (r *jwtRewriter) rewrite(req *http.Request, identity *tlsca.Identity) error {
+	token, err := r.key.Sign(jwt.SignParams{
+		Username: identity.Username,
+		Roles:    identity.Groups,
+		Traits:   r.filterTraits(identity.Traits),
+		Audience: r.config.Audience,
+		Expires:  time.Now().Add(r.config.RolloverPeriod),
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	req.Header.Set(r.config.Header, token)
+	return nil
+}
+
+// filterTraits applies the Claims allow/deny lists to the identity's
+// traits before they're embedded in the JWT.
+func (r *jwtRewriter) filterTraits(traits map[string][]string) map[string][]string {
+	allow := make(map[string]bool, len(r.config.Claims.Allow))
+	for _, name := range r.config.Claims.Allow {
+		allow[name] = true
+	}
+	deny := make(map[string]bool, len(r.config.Claims.Deny))
+	for _, name := range r.config.Claims.Deny {
+		deny[name] = true
+	}
+
+	out := make(map[string][]string, len(traits))
+	for name, values := range traits {
+		if len(allow) != 0 && !allow[name] {
+			continue
+		}
+		if deny[name] {
+			continue
+		}
+		out[name] = values
+	}
+	return out
+}
+
+// jwksHandler serves the public half of the app's JWT signing key(s) as
+// a JSON Web Key Set so upstream applications can validate the injected
+// JWT assertion header without contacting the Teleport auth server
+// directly.
+func jwksHandler(key *jwt.Key) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keySet, err := key.GetKeys()
+		if err != nil {
+			http.Error(w, trace.UserMessage(err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(keySet); err != nil {
+			http.Error(w, trace.UserMessage(err), http.StatusInternalServerError)
+		}
+	}
+}
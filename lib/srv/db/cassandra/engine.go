@@ -0,0 +1,182 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cassandra implements the database access engine that proxies
+// the Cassandra native protocol (CQL v4) to Cassandra and DataStax
+// Enterprise clusters.
+package cassandra
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport/lib/srv/db/common"
+
+	"github.com/gravitational/trace"
+)
+
+// defaultConnectTimeout is how long to wait when dialing the target
+// Cassandra contact point.
+const defaultConnectTimeout = 5 * time.Second
+
+// cassandraURIScheme is the optional scheme prefix on a Cassandra URI
+// indicating the connection should use native protocol TLS. It mirrors
+// the constant the config validator checks the URI against.
+const cassandraURIScheme = "cassandras://"
+
+// pickContactPoint parses a Cassandra URI of the form validated by
+// checkCassandraURI ("host1:9042,host2:9042", with an optional
+// "cassandras://" TLS scheme prefix) and returns a single contact point
+// to dial along with whether the connection should be TLS-wrapped.
+func pickContactPoint(uri string) (contactPoint string, useTLS bool) {
+	useTLS = strings.HasPrefix(uri, cassandraURIScheme)
+	uri = strings.TrimPrefix(uri, cassandraURIScheme)
+	contactPoints := strings.Split(uri, ",")
+	return contactPoints[rand.Intn(len(contactPoints))], useTLS
+}
+
+// Engine implements the Cassandra native protocol database access engine.
+// It sends the session's database user to the target cluster in a
+// Cassandra AUTH_RESPONSE frame and then proxies frames between the
+// client and the cluster, over TLS when the URI has the "cassandras://"
+// scheme and over plain TCP otherwise.
+type Engine struct {
+	// EngineConfig is the common database engine configuration.
+	common.EngineConfig
+	// clientConn is the incoming client connection.
+	clientConn net.Conn
+}
+
+// NewEngine creates a new Cassandra engine instance.
+func NewEngine(ec common.EngineConfig) common.Engine {
+	return &Engine{EngineConfig: ec}
+}
+
+// InitializeConnection initializes the database connection.
+func (e *Engine) InitializeConnection(clientConn net.Conn, _ *common.Session) error {
+	e.clientConn = clientConn
+	return nil
+}
+
+// SendError logs the error. No ERROR frame is written to the connected
+// client.
+func (e *Engine) SendError(err error) {
+	if err == nil || trace.Unwrap(err) == io.EOF {
+		return
+	}
+	e.Log.WithError(err).Error("Cassandra connection error.")
+}
+
+// HandleConnection authenticates the client using its Teleport-issued
+// certificate, enforces the session's role-based access filters and then
+// proxies CQL frames between the client and the target Cassandra cluster.
+func (e *Engine) HandleConnection(ctx context.Context, sessionCtx *common.Session) error {
+	if err := e.checkAccess(sessionCtx); err != nil {
+		return trace.Wrap(err)
+	}
+
+	serverConn, err := e.connect(ctx, sessionCtx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer serverConn.Close()
+
+	return trace.Wrap(e.proxy(ctx, sessionCtx, serverConn))
+}
+
+// checkAccess checks that the session's Teleport role set grants access
+// to the database, the database user and the database name.
+func (e *Engine) checkAccess(sessionCtx *common.Session) error {
+	return trace.Wrap(sessionCtx.Checker.CheckAccess(
+		sessionCtx.Database,
+		common.AccessModeNone,
+		sessionCtx.DatabaseUser,
+		sessionCtx.DatabaseName))
+}
+
+// connect opens a connection to a randomly chosen Cassandra contact
+// point, TLS-wrapped when the URI has the "cassandras://" scheme, and
+// writes an AUTH_RESPONSE frame for the session's database user. No
+// STARTUP frame is sent and no server reply is read.
+func (e *Engine) connect(ctx context.Context, sessionCtx *common.Session) (net.Conn, error) {
+	contactPoint, useTLS := pickContactPoint(sessionCtx.Database.GetURI())
+
+	dialer := &net.Dialer{Timeout: defaultConnectTimeout}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		tlsConfig, tlsErr := e.GetTLSConfig(ctx, sessionCtx)
+		if tlsErr != nil {
+			return nil, trace.Wrap(tlsErr)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", contactPoint, tlsConfig)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", contactPoint)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if err := e.authenticate(conn, sessionCtx); err != nil {
+		conn.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	return conn, nil
+}
+
+// authenticate writes a single CQL v4 AUTH_RESPONSE frame carrying the
+// session's database user to serverConn. It does not wait for an
+// AUTHENTICATE request or read the server's reply.
+func (e *Engine) authenticate(serverConn net.Conn, sessionCtx *common.Session) error {
+	frame, err := buildAuthResponseFrame(sessionCtx.DatabaseUser)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = serverConn.Write(frame)
+	return trace.Wrap(err)
+}
+
+// proxy copies CQL frames between the client and server connections until
+// either side closes.
+func (e *Engine) proxy(ctx context.Context, sessionCtx *common.Session, serverConn net.Conn) error {
+	clientErrCh := make(chan error, 1)
+	serverErrCh := make(chan error, 1)
+
+	go func() {
+		_, err := io.Copy(serverConn, e.clientConn)
+		clientErrCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(e.clientConn, serverConn)
+		serverErrCh <- err
+	}()
+
+	select {
+	case err := <-clientErrCh:
+		return trace.Wrap(err)
+	case err := <-serverErrCh:
+		return trace.Wrap(err)
+	case <-ctx.Done():
+		return trace.Wrap(ctx.Err())
+	}
+}
+
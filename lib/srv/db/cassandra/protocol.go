@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cassandra
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/gravitational/trace"
+)
+
+// CQL v4 OPCODEs relevant to the AUTH_RESPONSE handshake.
+// See https://github.com/apache/cassandra/blob/trunk/doc/native_protocol_v4.spec
+const (
+	opcodeAuthResponse byte = 0x0f
+	protocolVersionV4  byte = 0x04
+)
+
+// buildAuthResponseFrame builds a minimal CQL v4 AUTH_RESPONSE frame
+// carrying the given database user as the SASL PLAIN token. Teleport
+// itself authenticates the client upstream via mTLS; this response is
+// only used to satisfy Cassandra's SASL handshake with the username the
+// session was authorized for.
+func buildAuthResponseFrame(databaseUser string) ([]byte, error) {
+	if databaseUser == "" {
+		return nil, trace.BadParameter("missing Cassandra database user")
+	}
+
+	// SASL PLAIN token is "authzid\x00authcid\x00password"; authzid and
+	// password are left empty, giving "\x00<databaseUser>\x00".
+	token := bytes.Join([][]byte{{}, []byte(databaseUser), {}}, []byte{0})
+
+	body := &bytes.Buffer{}
+	if err := binary.Write(body, binary.BigEndian, int32(len(token))); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	body.Write(token)
+
+	header := []byte{
+		protocolVersionV4,
+		0x00, // flags
+		0x00, 0x00, // stream ID
+		opcodeAuthResponse,
+	}
+
+	frame := &bytes.Buffer{}
+	frame.Write(header)
+	if err := binary.Write(frame, binary.BigEndian, uint32(body.Len())); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	frame.Write(body.Bytes())
+
+	return frame.Bytes(), nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gravitational/teleport/lib/srv/db/common"
+
+	"github.com/gravitational/trace"
+)
+
+// cosmosDBDataContributorRoleName is the built-in Azure role that grants
+// read/write access to a CosmosDB (SQL API) account's data plane.
+const cosmosDBDataContributorRoleName = "Cosmos DB Built-in Data Contributor"
+
+// processAzureTask assigns or removes the Teleport-managed service
+// principal's "Cosmos DB Built-in Data Contributor" role on the target
+// CosmosDB account.
+func (c *IAM) processAzureTask(ctx context.Context, task iamTask) error {
+	azure := task.database.GetAzure()
+	if azure.SubscriptionID == "" || azure.CosmosDB.AccountName == "" {
+		c.cfg.Log.Debugf("Database %v is missing Azure resource metadata, skipping IAM configuration.", task.database.GetName())
+		return nil
+	}
+
+	client, err := c.cfg.Clients.GetAzureRoleAssignmentsClient(azure.SubscriptionID)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	scope := cosmosDBAccountScope(azure.SubscriptionID, azure.ResourceGroup, azure.CosmosDB.AccountName)
+
+	if task.isSetup {
+		err := common.ConvertError(client.AssignRole(ctx, scope, cosmosDBDataContributorRoleName))
+		if err != nil && !trace.IsAlreadyExists(err) {
+			return trace.Wrap(err)
+		}
+		return nil
+	}
+
+	err = common.ConvertError(client.RemoveRole(ctx, scope, cosmosDBDataContributorRoleName))
+	if err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// cosmosDBAccountScope builds the Azure resource ID used as the role
+// assignment scope for a CosmosDB account.
+func cosmosDBAccountScope(subscriptionID, resourceGroup, accountName string) string {
+	return fmt.Sprintf(
+		"/subscriptions/%v/resourceGroups/%v/providers/Microsoft.DocumentDB/databaseAccounts/%v",
+		subscriptionID, resourceGroup, accountName)
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cloud auto-configures IAM permissions required to connect to
+// cloud databases (AWS RDS/Aurora/Redshift, Azure CosmosDB, ...).
+package cloud
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/api/types"
+	"github.com/gravitational/teleport/lib/limiter"
+	"github.com/gravitational/teleport/lib/srv/db/common"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// databaseAccessInlinePolicyName is the name of the inline policy
+// attached to an IAM role granting it access to Teleport-managed
+// databases.
+const databaseAccessInlinePolicyName = "teleport-db-access"
+
+// IAMConfig is the configuration for an IAM configurator.
+type IAMConfig struct {
+	// Clients is an interface for obtaining cloud provider clients.
+	Clients common.CloudClients
+	// Semaphores is used to rate-limit config actions across multiple
+	// Teleport database service instances.
+	Semaphores types.Semaphores
+	// SetupRateLimiter rate-limits Setup calls per database. Teardown
+	// calls are not rate-limited.
+	SetupRateLimiter *limiter.RateLimiter
+	// HostID is the ID of this database service host.
+	HostID string
+	// MaxPanicRetries is the maximum number of times a task is re-queued
+	// after its processing panics, before it's dropped. Defaults to
+	// defaultMaxPanicRetries.
+	MaxPanicRetries int
+	// Log is the configurator logger.
+	Log log.FieldLogger
+}
+
+// CheckAndSetDefaults validates the config and sets defaults.
+func (c *IAMConfig) CheckAndSetDefaults() error {
+	if c.Clients == nil {
+		return trace.BadParameter("missing Clients")
+	}
+	if c.HostID == "" {
+		return trace.BadParameter("missing HostID")
+	}
+	if c.Semaphores == nil {
+		return trace.BadParameter("missing Semaphores")
+	}
+	if c.SetupRateLimiter == nil {
+		var err error
+		c.SetupRateLimiter, err = limiter.NewRateLimiter(limiter.Config{
+			Rates: []limiter.Rate{{
+				Period:  time.Minute,
+				Average: 10,
+				Burst:   10,
+			}},
+		})
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	if c.Log == nil {
+		c.Log = log.WithField(trace.Component, "cloud:iam")
+	}
+	if c.MaxPanicRetries == 0 {
+		c.MaxPanicRetries = defaultMaxPanicRetries
+	}
+	return nil
+}
+
+// defaultMaxPanicRetries is the default number of times a task is
+// re-queued after its processing panics.
+const defaultMaxPanicRetries = 3
+
+// iamTask represents a pending IAM setup/teardown task for a database.
+type iamTask struct {
+	// isSetup indicates whether this is a setup (true) or teardown
+	// (false) task.
+	isSetup bool
+	// database is the database the task applies to.
+	database types.Database
+	// panicRetries is the number of times this task has already been
+	// re-queued after a panic.
+	panicRetries int
+}
+
+// operation returns a human-readable, metric-friendly name for the task.
+func (t iamTask) operation() string {
+	if t.isSetup {
+		return "setup"
+	}
+	return "teardown"
+}
+
+// IAM is a configurator that auto-configures cloud IAM policies so
+// Teleport can authenticate to cloud databases.
+type IAM struct {
+	cfg IAMConfig
+
+	mu          sync.Mutex
+	processing  bool
+	tasks       chan iamTask
+	closeCtx    context.Context
+	closeCancel context.CancelFunc
+}
+
+// NewIAM returns a new IAM configurator instance.
+func NewIAM(ctx context.Context, cfg IAMConfig) (*IAM, error) {
+	if err := cfg.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	closeCtx, closeCancel := context.WithCancel(ctx)
+	return &IAM{
+		cfg:         cfg,
+		tasks:       make(chan iamTask, 100),
+		closeCtx:    closeCtx,
+		closeCancel: closeCancel,
+	}, nil
+}
+
+// Start starts the configurator's background task processing loop. It
+// runs until the context the configurator was created with is canceled.
+// A panic while processing a single task is recovered, logged and
+// re-queued with exponential backoff rather than taking down the loop
+// for all subsequent databases.
+func (c *IAM) Start() {
+	for {
+		select {
+		case task := <-c.tasks:
+			c.setProcessing(true)
+			err := c.processTaskRecovered(c.closeCtx, task)
+			c.setProcessing(false)
+			if err != nil {
+				c.cfg.Log.WithError(err).Errorf("Failed to auto-configure IAM for %v.", task.database.GetName())
+			}
+		case <-c.closeCtx.Done():
+			return
+		}
+	}
+}
+
+// Close stops the configurator's background loop.
+func (c *IAM) Close() {
+	c.closeCancel()
+}
+
+// Setup sets up IAM configuration for the provided database.
+func (c *IAM) Setup(ctx context.Context, database types.Database) error {
+	return trace.Wrap(c.queueTask(ctx, iamTask{isSetup: true, database: database}))
+}
+
+// Teardown tears down IAM configuration for the provided database.
+func (c *IAM) Teardown(ctx context.Context, database types.Database) error {
+	return trace.Wrap(c.queueTask(ctx, iamTask{isSetup: false, database: database}))
+}
+
+// queueTask enqueues a task for background processing, rate-limiting
+// setup tasks per database.
+func (c *IAM) queueTask(ctx context.Context, task iamTask) error {
+	if task.isSetup && c.cfg.SetupRateLimiter != nil {
+		if err := c.cfg.SetupRateLimiter.RegisterRequestWithCustomRate(task.database.GetName(), nil); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	select {
+	case c.tasks <- task:
+		return nil
+	case <-ctx.Done():
+		return trace.Wrap(ctx.Err())
+	}
+}
+
+// isIdle returns true when there are no pending or in-flight tasks. It is
+// primarily used by tests to wait for the background loop to drain.
+func (c *IAM) isIdle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.processing && len(c.tasks) == 0
+}
+
+func (c *IAM) setProcessing(processing bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.processing = processing
+}
+
+// processTask applies a single setup/teardown task for AWS (RDS, Aurora,
+// Redshift) or Azure (CosmosDB) databases. Missing AWS permissions are
+// logged and not returned as an error.
+func (c *IAM) processTask(ctx context.Context, task iamTask) error {
+	meta := task.database.GetAWS()
+	if meta.Region != "" || meta.RDS.ResourceID != "" || meta.Redshift.ClusterID != "" {
+		err := c.processAWSTask(ctx, task)
+		if trace.IsAccessDenied(err) {
+			c.cfg.Log.WithError(err).Warnf("No permissions to auto-configure IAM for %v, skipping.", task.database.GetName())
+			return nil
+		}
+		return trace.Wrap(err)
+	}
+	if task.database.GetAzure().SubscriptionID != "" {
+		return trace.Wrap(c.processAzureTask(ctx, task))
+	}
+	c.cfg.Log.Debugf("Database %v has no cloud metadata, skipping IAM configuration.", task.database.GetName())
+	return nil
+}
+
+// processAWSTask attaches or detaches the database's resource ID from the
+// IAM role's inline access policy.
+func (c *IAM) processAWSTask(ctx context.Context, task iamTask) error {
+	resourceID := awsResourceID(task.database)
+	if resourceID == "" {
+		c.cfg.Log.Debugf("Database %v is missing AWS resource metadata, skipping IAM configuration.", task.database.GetName())
+		return nil
+	}
+
+	stsClient, err := c.cfg.Clients.GetAWSSTSClient(task.database.GetAWS().Region)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	identity, err := stsClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return trace.Wrap(common.ConvertError(err))
+	}
+	roleName, err := roleNameFromARN(aws.StringValue(identity.Arn))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := c.enableIAMAuth(ctx, task.database); err != nil {
+		return trace.Wrap(err)
+	}
+
+	iamClient, err := c.cfg.Clients.GetAWSIAMClient(task.database.GetAWS().Region)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !task.isSetup {
+		return trace.Wrap(removeResourceFromPolicy(ctx, iamClient, roleName, resourceID))
+	}
+
+	if err := addResourceToPolicy(ctx, iamClient, roleName, resourceID); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if err := c.orderEndpointsByLocality(ctx, task.database); err != nil {
+		// Locality ordering is an optimization, not a correctness
+		// requirement: if it fails, fall back to the API's natural
+		// endpoint order rather than failing the whole setup.
+		c.cfg.Log.WithError(err).Warnf("Failed to order endpoints by locality for %v.", task.database.GetName())
+	}
+
+	return nil
+}
+
+// enableIAMAuth enables IAM database authentication on the target RDS
+// instance or Aurora cluster. It's a no-op for Redshift, which doesn't
+// require this step.
+func (c *IAM) enableIAMAuth(ctx context.Context, database types.Database) error {
+	meta := database.GetAWS()
+	switch {
+	case meta.RDS.ClusterID != "":
+		rdsClient, err := c.cfg.Clients.GetAWSRDSClient(meta.Region)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		_, err = rdsClient.ModifyDBClusterWithContext(ctx, &rds.ModifyDBClusterInput{
+			DBClusterIdentifier:             aws.String(meta.RDS.ClusterID),
+			EnableIAMDatabaseAuthentication: aws.Bool(true),
+		})
+		return trace.Wrap(common.ConvertError(err))
+	case meta.RDS.InstanceID != "":
+		rdsClient, err := c.cfg.Clients.GetAWSRDSClient(meta.Region)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		_, err = rdsClient.ModifyDBInstanceWithContext(ctx, &rds.ModifyDBInstanceInput{
+			DBInstanceIdentifier:            aws.String(meta.RDS.InstanceID),
+			EnableIAMDatabaseAuthentication: aws.Bool(true),
+		})
+		return trace.Wrap(common.ConvertError(err))
+	}
+	return nil
+}
+
+// migrateInlinePolicy removes the legacy per-host inline policy used
+// before all databases were consolidated under a single
+// databaseAccessInlinePolicyName policy.
+//
+// DELETE IN 11.0.
+func (c *IAM) migrateInlinePolicy(ctx context.Context) {
+	stsClient, err := c.cfg.Clients.GetAWSSTSClient("")
+	if err != nil {
+		c.cfg.Log.WithError(err).Debug("Failed to get STS client during inline policy migration.")
+		return
+	}
+	identity, err := stsClient.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		c.cfg.Log.WithError(err).Debug("Failed to get caller identity during inline policy migration.")
+		return
+	}
+	roleName, err := roleNameFromARN(aws.StringValue(identity.Arn))
+	if err != nil {
+		c.cfg.Log.WithError(err).Debug("Failed to parse role name during inline policy migration.")
+		return
+	}
+	iamClient, err := c.cfg.Clients.GetAWSIAMClient("")
+	if err != nil {
+		c.cfg.Log.WithError(err).Debug("Failed to get IAM client during inline policy migration.")
+		return
+	}
+	legacyPolicyName := "teleport-" + c.cfg.HostID
+	_, err = iamClient.DeleteRolePolicyWithContext(ctx, &iam.DeleteRolePolicyInput{
+		RoleName:   aws.String(roleName),
+		PolicyName: aws.String(legacyPolicyName),
+	})
+	if err != nil && !trace.IsNotFound(common.ConvertError(err)) {
+		c.cfg.Log.WithError(err).Debug("Failed to delete legacy inline policy.")
+	}
+}
+
+// awsResourceID returns the resource ID used to scope the IAM policy
+// statement for the database. It returns "" if the database is missing
+// the region or account ID needed to form a valid resource ARN.
+func awsResourceID(database types.Database) string {
+	meta := database.GetAWS()
+	if meta.Region == "" || meta.AccountID == "" {
+		return ""
+	}
+	switch {
+	case meta.RDS.ResourceID != "":
+		return meta.RDS.ResourceID
+	case meta.Redshift.ClusterID != "":
+		return meta.Redshift.ClusterID
+	}
+	return ""
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/aws/aws-sdk-go/service/redshift"
+	"github.com/aws/aws-sdk-go/service/redshift/redshiftiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+
+	"github.com/gravitational/trace"
+)
+
+// STSMock is a mock STS client for tests. It returns a fixed caller
+// identity ARN.
+type STSMock struct {
+	stsiface.STSAPI
+	ARN string
+}
+
+func (m *STSMock) GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(m.ARN)}, nil
+}
+
+// RDSMock is a mock RDS client for tests.
+type RDSMock struct {
+	rdsiface.RDSAPI
+	DBInstances []*rds.DBInstance
+	DBClusters  []*rds.DBCluster
+	// ClusterEndpoints are returned by DescribeDBClusterEndpointsWithContext.
+	ClusterEndpoints []*rds.DBClusterEndpoint
+	// ClusterMembers are the instances returned by
+	// DescribeDBInstancesWithContext when filtered by "db-cluster-id".
+	ClusterMembers []*rds.DBInstance
+}
+
+func (m *RDSMock) DescribeDBClusterEndpointsWithContext(_ aws.Context, in *rds.DescribeDBClusterEndpointsInput, _ ...request.Option) (*rds.DescribeDBClusterEndpointsOutput, error) {
+	var out []*rds.DBClusterEndpoint
+	for _, e := range m.ClusterEndpoints {
+		if aws.StringValue(e.DBClusterIdentifier) == aws.StringValue(in.DBClusterIdentifier) {
+			out = append(out, e)
+		}
+	}
+	return &rds.DescribeDBClusterEndpointsOutput{DBClusterEndpoints: out}, nil
+}
+
+func (m *RDSMock) DescribeDBInstancesWithContext(_ aws.Context, in *rds.DescribeDBInstancesInput, _ ...request.Option) (*rds.DescribeDBInstancesOutput, error) {
+	if in.DBInstanceIdentifier != nil {
+		for _, instance := range m.DBInstances {
+			if aws.StringValue(instance.DBInstanceIdentifier) == aws.StringValue(in.DBInstanceIdentifier) {
+				return &rds.DescribeDBInstancesOutput{DBInstances: []*rds.DBInstance{instance}}, nil
+			}
+		}
+		return nil, trace404()
+	}
+	for _, filter := range in.Filters {
+		if aws.StringValue(filter.Name) != "db-cluster-id" || len(filter.Values) == 0 {
+			continue
+		}
+		clusterID := aws.StringValue(filter.Values[0])
+		var out []*rds.DBInstance
+		for _, instance := range m.ClusterMembers {
+			if aws.StringValue(instance.DBClusterIdentifier) == clusterID {
+				out = append(out, instance)
+			}
+		}
+		return &rds.DescribeDBInstancesOutput{DBInstances: out}, nil
+	}
+	return &rds.DescribeDBInstancesOutput{DBInstances: m.DBInstances}, nil
+}
+
+func (m *RDSMock) ModifyDBInstanceWithContext(_ aws.Context, in *rds.ModifyDBInstanceInput, _ ...request.Option) (*rds.ModifyDBInstanceOutput, error) {
+	for _, instance := range m.DBInstances {
+		if aws.StringValue(instance.DBInstanceIdentifier) == aws.StringValue(in.DBInstanceIdentifier) {
+			instance.IAMDatabaseAuthenticationEnabled = in.EnableIAMDatabaseAuthentication
+			return &rds.ModifyDBInstanceOutput{DBInstance: instance}, nil
+		}
+	}
+	return nil, trace404()
+}
+
+func (m *RDSMock) ModifyDBClusterWithContext(_ aws.Context, in *rds.ModifyDBClusterInput, _ ...request.Option) (*rds.ModifyDBClusterOutput, error) {
+	for _, cluster := range m.DBClusters {
+		if aws.StringValue(cluster.DBClusterIdentifier) == aws.StringValue(in.DBClusterIdentifier) {
+			cluster.IAMDatabaseAuthenticationEnabled = in.EnableIAMDatabaseAuthentication
+			return &rds.ModifyDBClusterOutput{DBCluster: cluster}, nil
+		}
+	}
+	return nil, trace404()
+}
+
+// RDSMockUnauth is an RDS client mock that denies all requests.
+type RDSMockUnauth struct {
+	rdsiface.RDSAPI
+}
+
+func (m *RDSMockUnauth) ModifyDBInstanceWithContext(aws.Context, *rds.ModifyDBInstanceInput, ...request.Option) (*rds.ModifyDBInstanceOutput, error) {
+	return nil, awserr.New("AccessDenied", "not authorized", nil)
+}
+
+func (m *RDSMockUnauth) ModifyDBClusterWithContext(aws.Context, *rds.ModifyDBClusterInput, ...request.Option) (*rds.ModifyDBClusterOutput, error) {
+	return nil, awserr.New("AccessDenied", "not authorized", nil)
+}
+
+// RedshiftMock is a mock Redshift client for tests.
+type RedshiftMock struct {
+	redshiftiface.RedshiftAPI
+	Clusters []*redshift.Cluster
+}
+
+// RedshiftMockUnauth is a Redshift client mock that denies all requests.
+type RedshiftMockUnauth struct {
+	redshiftiface.RedshiftAPI
+}
+
+// IAMMock is a mock IAM client for tests, storing inline role policies
+// in memory.
+type IAMMock struct {
+	iamiface.IAMAPI
+
+	mu                   sync.Mutex
+	attachedRolePolicies map[string]map[string]string
+}
+
+func (m *IAMMock) GetRolePolicyWithContext(_ aws.Context, in *iam.GetRolePolicyInput, _ ...request.Option) (*iam.GetRolePolicyOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.attachedRolePolicies == nil {
+		m.attachedRolePolicies = make(map[string]map[string]string)
+	}
+	policy, ok := m.attachedRolePolicies[aws.StringValue(in.RoleName)][aws.StringValue(in.PolicyName)]
+	if !ok {
+		return nil, trace404()
+	}
+	return &iam.GetRolePolicyOutput{
+		RoleName:       in.RoleName,
+		PolicyName:     in.PolicyName,
+		PolicyDocument: aws.String(policy),
+	}, nil
+}
+
+func (m *IAMMock) PutRolePolicyWithContext(_ aws.Context, in *iam.PutRolePolicyInput, _ ...request.Option) (*iam.PutRolePolicyOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.attachedRolePolicies == nil {
+		m.attachedRolePolicies = make(map[string]map[string]string)
+	}
+	role := aws.StringValue(in.RoleName)
+	if m.attachedRolePolicies[role] == nil {
+		m.attachedRolePolicies[role] = make(map[string]string)
+	}
+	m.attachedRolePolicies[role][aws.StringValue(in.PolicyName)] = aws.StringValue(in.PolicyDocument)
+	return &iam.PutRolePolicyOutput{}, nil
+}
+
+func (m *IAMMock) DeleteRolePolicyWithContext(_ aws.Context, in *iam.DeleteRolePolicyInput, _ ...request.Option) (*iam.DeleteRolePolicyOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	role := aws.StringValue(in.RoleName)
+	if _, ok := m.attachedRolePolicies[role][aws.StringValue(in.PolicyName)]; !ok {
+		return nil, trace404()
+	}
+	delete(m.attachedRolePolicies[role], aws.StringValue(in.PolicyName))
+	return &iam.DeleteRolePolicyOutput{}, nil
+}
+
+// IAMMockPanic is an IAM client mock whose GetRolePolicyWithContext
+// panics the first panicCount times it's called, then behaves like a
+// normal IAMMock. It's used to exercise the configurator's panic
+// recovery middleware.
+type IAMMockPanic struct {
+	IAMMock
+	panicCount int
+	calls      int
+}
+
+func (m *IAMMockPanic) GetRolePolicyWithContext(ctx aws.Context, in *iam.GetRolePolicyInput, opts ...request.Option) (*iam.GetRolePolicyOutput, error) {
+	m.calls++
+	if m.calls <= m.panicCount {
+		var boom *iam.GetRolePolicyInput
+		return nil, trace404AndPanic(boom)
+	}
+	return m.IAMMock.GetRolePolicyWithContext(ctx, in, opts...)
+}
+
+// trace404AndPanic dereferences a nil *iam.GetRolePolicyInput, panicking
+// the same way a real AWS SDK response handler could on an unexpected
+// nil field.
+func trace404AndPanic(nilInput *iam.GetRolePolicyInput) error {
+	_ = nilInput.RoleName
+	return nil
+}
+
+// IAMMockUnauth is an IAM client mock that denies all requests.
+type IAMMockUnauth struct {
+	iamiface.IAMAPI
+}
+
+func (m *IAMMockUnauth) GetRolePolicyWithContext(aws.Context, *iam.GetRolePolicyInput, ...request.Option) (*iam.GetRolePolicyOutput, error) {
+	return nil, awserr.New("AccessDenied", "not authorized", nil)
+}
+
+func (m *IAMMockUnauth) PutRolePolicyWithContext(aws.Context, *iam.PutRolePolicyInput, ...request.Option) (*iam.PutRolePolicyOutput, error) {
+	return nil, awserr.New("AccessDenied", "not authorized", nil)
+}
+
+func (m *IAMMockUnauth) DeleteRolePolicyWithContext(aws.Context, *iam.DeleteRolePolicyInput, ...request.Option) (*iam.DeleteRolePolicyOutput, error) {
+	return nil, awserr.New("AccessDenied", "not authorized", nil)
+}
+
+// SemaphoresMock is a no-op semaphore implementation for tests.
+type SemaphoresMock struct {
+	types.Semaphores
+}
+
+func (m *SemaphoresMock) AcquireSemaphore(context.Context, types.AcquireSemaphoreRequest) (*types.SemaphoreLease, error) {
+	return &types.SemaphoreLease{}, nil
+}
+
+func (m *SemaphoresMock) CancelSemaphoreLease(context.Context, types.SemaphoreLease) error {
+	return nil
+}
+
+func trace404() error {
+	return awserr.New("NoSuchEntity", "not found", nil)
+}
+
+// AzureRoleAssignmentsMock is a mock Azure role assignments client for
+// tests, tracking assigned roles per scope in memory.
+type AzureRoleAssignmentsMock struct {
+	mu    sync.Mutex
+	roles map[string]map[string]bool
+}
+
+// AssignRole mimics the real Azure role-assignment PUT: assigning a role
+// that's already present on the scope returns a 409 Conflict, surfaced
+// here as a trace.AlreadyExists error.
+func (m *AzureRoleAssignmentsMock) AssignRole(_ context.Context, scope, roleName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.roles == nil {
+		m.roles = make(map[string]map[string]bool)
+	}
+	if m.roles[scope] == nil {
+		m.roles[scope] = make(map[string]bool)
+	}
+	if m.roles[scope][roleName] {
+		return trace.AlreadyExists("role assignment %q already exists on scope %q", roleName, scope)
+	}
+	m.roles[scope][roleName] = true
+	return nil
+}
+
+// RemoveRole mimics the real Azure role-assignment DELETE: removing a
+// role that isn't present returns a 404, surfaced as a trace.NotFound
+// error.
+func (m *AzureRoleAssignmentsMock) RemoveRole(_ context.Context, scope, roleName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.roles[scope][roleName] {
+		return trace.NotFound("role assignment %q not found on scope %q", roleName, scope)
+	}
+	delete(m.roles[scope], roleName)
+	return nil
+}
+
+func (m *AzureRoleAssignmentsMock) HasRole(scope, roleName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.roles[scope][roleName]
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/redshift"
 
+	promTestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -67,6 +68,34 @@ func TestAWSIAM(t *testing.T) {
 	rdsClient := &RDSMock{
 		DBInstances: []*rds.DBInstance{rdsInstance},
 		DBClusters:  []*rds.DBCluster{auroraCluster},
+		ClusterEndpoints: []*rds.DBClusterEndpoint{
+			{
+				DBClusterIdentifier:         aws.String("postgres-aurora"),
+				DBClusterEndpointIdentifier: aws.String("postgres-aurora-custom-1"),
+				Endpoint:                    aws.String("postgres-aurora-custom-1.aurora.us-east-1.rds.amazonaws.com"),
+				EndpointType:                aws.String("READER"),
+				StaticMembers:               []*string{aws.String("postgres-aurora-reader-1")},
+			},
+			{
+				DBClusterIdentifier:         aws.String("postgres-aurora"),
+				DBClusterEndpointIdentifier: aws.String("postgres-aurora-custom-2"),
+				Endpoint:                    aws.String("postgres-aurora-custom-2.aurora.us-east-1.rds.amazonaws.com"),
+				EndpointType:                aws.String("READER"),
+				StaticMembers:               []*string{aws.String("postgres-aurora-reader-2")},
+			},
+		},
+		ClusterMembers: []*rds.DBInstance{
+			{
+				DBInstanceIdentifier: aws.String("postgres-aurora-reader-1"),
+				DBClusterIdentifier:  aws.String("postgres-aurora"),
+				AvailabilityZone:     aws.String("us-east-1a"),
+			},
+			{
+				DBInstanceIdentifier: aws.String("postgres-aurora-reader-2"),
+				DBClusterIdentifier:  aws.String("postgres-aurora"),
+				AvailabilityZone:     aws.String("us-east-1b"),
+			},
+		},
 	}
 
 	redshiftClient := &RedshiftMock{
@@ -74,6 +103,7 @@ func TestAWSIAM(t *testing.T) {
 	}
 
 	iamClient := &IAMMock{}
+	azureClient := &AzureRoleAssignmentsMock{}
 
 	limiterClock := timetools.SleepProvider(time.Now())
 	limiter, err := limiter.NewRateLimiter(limiter.Config{
@@ -105,6 +135,34 @@ func TestAWSIAM(t *testing.T) {
 	})
 	require.NoError(t, err)
 
+	auroraLocalityDatabase, err := types.NewDatabaseV3(types.Metadata{
+		Name: "postgres-aurora",
+	}, types.DatabaseSpecV3{
+		Protocol: defaults.ProtocolPostgres,
+		URI:      "localhost",
+		AWS: types.AWS{
+			Region:    "localhost",
+			AccountID: "1234567890",
+			RDS:       types.RDS{ClusterID: "postgres-aurora", ResourceID: "postgres-aurora-resource-id"},
+			Locality:  types.AWSLocality{AvailabilityZone: "us-east-1b"},
+		},
+	})
+	require.NoError(t, err)
+
+	auroraLocalityFallbackDatabase, err := types.NewDatabaseV3(types.Metadata{
+		Name: "postgres-aurora",
+	}, types.DatabaseSpecV3{
+		Protocol: defaults.ProtocolPostgres,
+		URI:      "localhost",
+		AWS: types.AWS{
+			Region:    "localhost",
+			AccountID: "1234567890",
+			RDS:       types.RDS{ClusterID: "postgres-aurora", ResourceID: "postgres-aurora-resource-id"},
+			Locality:  types.AWSLocality{AvailabilityZone: "us-east-1c"},
+		},
+	})
+	require.NoError(t, err)
+
 	redshiftDatabase, err := types.NewDatabaseV3(types.Metadata{
 		Name: "redshift",
 	}, types.DatabaseSpecV3{
@@ -123,14 +181,28 @@ func TestAWSIAM(t *testing.T) {
 	})
 	require.NoError(t, err)
 
+	cosmosDatabase, err := types.NewDatabaseV3(types.Metadata{
+		Name: "cosmosdb",
+	}, types.DatabaseSpecV3{
+		Protocol: defaults.ProtocolCosmosDB,
+		URI:      "https://cosmos-1.documents.azure.com:443",
+		Azure: types.Azure{
+			SubscriptionID: "sub-1",
+			ResourceGroup:  "rg-1",
+			CosmosDB:       types.AzureCosmosDB{AccountName: "cosmos-1"},
+		},
+	})
+	require.NoError(t, err)
+
 	// Make configurator.
 	configurator, err := NewIAM(ctx, IAMConfig{
 		Semaphores: &SemaphoresMock{},
 		Clients: &common.TestCloudClients{
-			RDS:      rdsClient,
-			Redshift: redshiftClient,
-			STS:      stsClient,
-			IAM:      iamClient,
+			RDS:                  rdsClient,
+			Redshift:             redshiftClient,
+			STS:                  stsClient,
+			IAM:                  iamClient,
+			AzureRoleAssignments: azureClient,
 		},
 		HostID:           "host-id",
 		SetupRateLimiter: limiter,
@@ -172,6 +244,68 @@ func TestAWSIAM(t *testing.T) {
 		require.NotContains(t, policy, auroraDatabase.GetAWS().RDS.ResourceID)
 	})
 
+	t.Run("Aurora locality-aware endpoint selection", func(t *testing.T) {
+		// The cluster has readers in us-east-1a and us-east-1b; the
+		// database prefers us-east-1b, so that reader should be sorted
+		// first. The Aurora subtest already set up a database of the same
+		// name, so the rate limit is lifted first.
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Setup(ctx, auroraLocalityDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+
+		endpoints := auroraLocalityDatabase.GetAWSRDSEndpoints()
+		require.Len(t, endpoints, 2)
+		require.Equal(t, "postgres-aurora-custom-2.aurora.us-east-1.rds.amazonaws.com", endpoints[0])
+
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Teardown(ctx, auroraLocalityDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+	})
+
+	t.Run("Aurora locality fallback when preferred AZ is unhealthy", func(t *testing.T) {
+		// us-east-1c isn't one of the cluster's reader AZs, so neither
+		// endpoint matches and both are returned in their natural order
+		// rather than erroring out.
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Setup(ctx, auroraLocalityFallbackDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+
+		endpoints := auroraLocalityFallbackDatabase.GetAWSRDSEndpoints()
+		require.Len(t, endpoints, 2)
+
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Teardown(ctx, auroraLocalityFallbackDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+	})
+
+	t.Run("CosmosDB", func(t *testing.T) {
+		scope := cosmosDBAccountScope("sub-1", "rg-1", "cosmos-1")
+
+		// Configure CosmosDB database and make sure the role was assigned.
+		err = configurator.Setup(ctx, cosmosDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+		require.True(t, azureClient.HasRole(scope, cosmosDBDataContributorRoleName))
+
+		// Setting up the same database again should be idempotent.
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Setup(ctx, cosmosDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+		require.True(t, azureClient.HasRole(scope, cosmosDBDataContributorRoleName))
+
+		// Deconfigure CosmosDB database, role assignment should be removed.
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Teardown(ctx, cosmosDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+		require.False(t, azureClient.HasRole(scope, cosmosDBDataContributorRoleName))
+	})
+
 	t.Run("Redshift", func(t *testing.T) {
 		// Configure Redshift database and make sure policy was attached.
 		err = configurator.Setup(ctx, redshiftDatabase)
@@ -188,6 +322,30 @@ func TestAWSIAM(t *testing.T) {
 		require.NotContains(t, policy, redshiftDatabase.GetAWS().Redshift.ClusterID)
 	})
 
+	t.Run("CosmosDB", func(t *testing.T) {
+		scope := cosmosDBAccountScope("sub-1", "rg-1", "cosmos-1")
+
+		// Configure CosmosDB database and make sure the role was assigned.
+		err = configurator.Setup(ctx, cosmosDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+		require.True(t, azureClient.HasRole(scope, cosmosDBDataContributorRoleName))
+
+		// Setting up the same database again should be idempotent.
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Setup(ctx, cosmosDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+		require.True(t, azureClient.HasRole(scope, cosmosDBDataContributorRoleName))
+
+		// Deconfigure CosmosDB database, role assignment should be removed.
+		timetools.AdvanceTimeBy(limiterClock, 2*time.Hour)
+		err = configurator.Teardown(ctx, cosmosDatabase)
+		require.NoError(t, err)
+		require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+		require.False(t, azureClient.HasRole(scope, cosmosDBDataContributorRoleName))
+	})
+
 	t.Run("rate limiting setup", func(t *testing.T) {
 		// Setup immediately for the same database should be rate limited.
 		err = configurator.Setup(ctx, redshiftDatabase)
@@ -209,6 +367,52 @@ func TestAWSIAM(t *testing.T) {
 	})
 }
 
+// TestIAMPanicRecovery verifies that a panic while processing a single
+// IAM task doesn't take down the configurator's background loop, and
+// that the task is retried before eventually succeeding.
+func TestIAMPanicRecovery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stsClient := &STSMock{ARN: "arn:aws:iam::1234567890:role/test-role"}
+	iamClient := &IAMMockPanic{panicCount: 2}
+
+	configurator, err := NewIAM(ctx, IAMConfig{
+		Semaphores: &SemaphoresMock{},
+		Clients: &common.TestCloudClients{
+			STS: stsClient,
+			IAM: iamClient,
+		},
+		HostID:          "host-id",
+		MaxPanicRetries: 5,
+	})
+	require.NoError(t, err)
+	go configurator.Start()
+
+	redshiftDatabase, err := types.NewDatabaseV3(types.Metadata{
+		Name: "redshift",
+	}, types.DatabaseSpecV3{
+		Protocol: defaults.ProtocolPostgres,
+		URI:      "localhost",
+		AWS:      types.AWS{Region: "localhost", AccountID: "1234567890", Redshift: types.Redshift{ClusterID: "redshift-cluster-1"}},
+	})
+	require.NoError(t, err)
+
+	countBefore := promTestutil.ToFloat64(iamTaskPanics.WithLabelValues("setup"))
+
+	err = configurator.Setup(ctx, redshiftDatabase)
+	require.NoError(t, err)
+	require.Eventuallyf(t, configurator.isIdle, 10*time.Second, 50*time.Millisecond, "database is not processed")
+
+	// The task should have eventually succeeded despite the first two
+	// attempts panicking.
+	policy := iamClient.attachedRolePolicies["test-role"][databaseAccessInlinePolicyName]
+	require.Contains(t, policy, redshiftDatabase.GetAWS().Redshift.ClusterID)
+
+	// The panic counter should have fired exactly twice.
+	require.Equal(t, countBefore+2, promTestutil.ToFloat64(iamTaskPanics.WithLabelValues("setup")))
+}
+
 // TestAWSIAMNoPermissions tests that lack of AWS permissions does not produce
 // errors during IAM auto-configuration.
 func TestAWSIAMNoPermissions(t *testing.T) {
@@ -0,0 +1,172 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"context"
+	"sort"
+
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+
+	"github.com/gravitational/trace"
+)
+
+// orderEndpointsByLocality enumerates the reader endpoints of an Aurora
+// cluster or the replicas of an RDS instance and sorts them so that
+// same-AZ endpoints come first, then same-region endpoints, then
+// everything else. The ordered list is recorded on the database
+// resource for the proxy engine to use when opening backend
+// connections.
+func (c *IAM) orderEndpointsByLocality(ctx context.Context, database types.Database) error {
+	meta := database.GetAWS()
+	if meta.Locality == (types.AWSLocality{}) {
+		// No locality preference was configured for this database, so
+		// endpoints are left in their natural (API-returned) order.
+		return nil
+	}
+
+	rdsClient, err := c.cfg.Clients.GetAWSRDSClient(meta.Region)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	var endpoints []endpointLocality
+	switch {
+	case meta.RDS.ClusterID != "":
+		endpoints, err = clusterEndpointsByLocality(ctx, rdsClient, meta.RDS.ClusterID, meta.Region)
+	case meta.RDS.InstanceID != "":
+		endpoints, err = instanceEndpointsByLocality(ctx, rdsClient, meta.RDS.InstanceID, meta.Region)
+	}
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	sortEndpointsByLocality(endpoints, meta.Locality)
+
+	database.SetAWSRDSEndpoints(localityEndpointAddrs(endpoints))
+	return nil
+}
+
+// endpointLocality pairs an endpoint address with the availability zone
+// and region it was reported in.
+type endpointLocality struct {
+	addr             string
+	availabilityZone string
+	region           string
+}
+
+// clusterEndpointsByLocality lists the reader endpoints of an Aurora
+// cluster. DescribeDBClusterEndpoints enumerates the cluster's reader
+// endpoints along with the StaticMembers backing each one, and
+// DescribeDBInstances is used to look up the availability zone of
+// those member instances.
+func clusterEndpointsByLocality(ctx context.Context, rdsClient rdsiface.RDSAPI, clusterID, region string) ([]endpointLocality, error) {
+	clusterEndpoints, err := rdsClient.DescribeDBClusterEndpointsWithContext(ctx, &rds.DescribeDBClusterEndpointsInput{
+		DBClusterIdentifier: aws.String(clusterID),
+		Filters: []*rds.Filter{{
+			Name:   aws.String("db-cluster-endpoint-type"),
+			Values: []*string{aws.String("READER")},
+		}},
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	members, err := rdsClient.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{
+		Filters: []*rds.Filter{{
+			Name:   aws.String("db-cluster-id"),
+			Values: []*string{aws.String(clusterID)},
+		}},
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	azByInstanceID := make(map[string]string, len(members.DBInstances))
+	for _, instance := range members.DBInstances {
+		azByInstanceID[aws.StringValue(instance.DBInstanceIdentifier)] = aws.StringValue(instance.AvailabilityZone)
+	}
+
+	var endpoints []endpointLocality
+	for _, e := range clusterEndpoints.DBClusterEndpoints {
+		var az string
+		for _, member := range e.StaticMembers {
+			if zone, ok := azByInstanceID[aws.StringValue(member)]; ok {
+				az = zone
+				break
+			}
+		}
+		endpoints = append(endpoints, endpointLocality{
+			addr:             aws.StringValue(e.Endpoint),
+			availabilityZone: az,
+			region:           region,
+		})
+	}
+	return endpoints, nil
+}
+
+// instanceEndpointsByLocality lists the replicas of an RDS instance.
+func instanceEndpointsByLocality(ctx context.Context, rdsClient rdsiface.RDSAPI, instanceID, region string) ([]endpointLocality, error) {
+	out, err := rdsClient.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(instanceID),
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var endpoints []endpointLocality
+	for _, instance := range out.DBInstances {
+		if instance.Endpoint == nil {
+			continue
+		}
+		endpoints = append(endpoints, endpointLocality{
+			addr:             aws.StringValue(instance.Endpoint.Address),
+			availabilityZone: aws.StringValue(instance.AvailabilityZone),
+			region:           region,
+		})
+	}
+	return endpoints, nil
+}
+
+// sortEndpointsByLocality sorts endpoints in place so the same-AZ
+// endpoint(s) come first, then same-region, then everything else.
+func sortEndpointsByLocality(endpoints []endpointLocality, preferred types.AWSLocality) {
+	score := func(e endpointLocality) int {
+		switch {
+		case preferred.AvailabilityZone != "" && e.availabilityZone == preferred.AvailabilityZone:
+			return 0
+		case preferred.Region != "" && e.region == preferred.Region:
+			return 1
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return score(endpoints[i]) < score(endpoints[j])
+	})
+}
+
+func localityEndpointAddrs(endpoints []endpointLocality) []string {
+	addrs := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		addrs = append(addrs, e.addr)
+	}
+	return addrs
+}
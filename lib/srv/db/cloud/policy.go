@@ -0,0 +1,157 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/gravitational/teleport/lib/srv/db/common"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	awsiamface "github.com/aws/aws-sdk-go/service/iam/iamiface"
+
+	"github.com/gravitational/trace"
+)
+
+// policyDocument is a minimal representation of an IAM policy document
+// good enough to add/remove database resource ARNs from a single "Allow
+// connect" statement.
+type policyDocument struct {
+	Version   string            `json:"Version"`
+	Statement []policyStatement `json:"Statement"`
+}
+
+type policyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// roleNameFromARN extracts the IAM role name from a caller identity ARN
+// such as "arn:aws:iam::1234567890:role/test-role".
+func roleNameFromARN(arn string) (string, error) {
+	parts := strings.Split(arn, "/")
+	if len(parts) < 2 || !strings.Contains(parts[0], ":role") {
+		return "", trace.BadParameter("failed to parse role name from ARN %q", arn)
+	}
+	return parts[len(parts)-1], nil
+}
+
+// getPolicyDocument fetches and parses the role's current database
+// access inline policy, returning an empty document if it doesn't exist
+// yet.
+func getPolicyDocument(ctx context.Context, iamClient awsiamface.IAMAPI, roleName string) (*policyDocument, error) {
+	out, err := iamClient.GetRolePolicyWithContext(ctx, &iam.GetRolePolicyInput{
+		RoleName:   aws.String(roleName),
+		PolicyName: aws.String(databaseAccessInlinePolicyName),
+	})
+	if err != nil {
+		if trace.IsNotFound(common.ConvertError(err)) {
+			return &policyDocument{Version: "2012-10-17"}, nil
+		}
+		return nil, trace.Wrap(common.ConvertError(err))
+	}
+
+	decoded, err := decodePolicyDocument(aws.StringValue(out.PolicyDocument))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var doc policyDocument
+	if err := json.Unmarshal([]byte(decoded), &doc); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &doc, nil
+}
+
+// putPolicyDocument saves the role's database access inline policy.
+func putPolicyDocument(ctx context.Context, iamClient awsiamface.IAMAPI, roleName string, doc *policyDocument) error {
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = iamClient.PutRolePolicyWithContext(ctx, &iam.PutRolePolicyInput{
+		RoleName:       aws.String(roleName),
+		PolicyName:     aws.String(databaseAccessInlinePolicyName),
+		PolicyDocument: aws.String(string(body)),
+	})
+	return trace.Wrap(common.ConvertError(err))
+}
+
+// addResourceToPolicy adds the resource ID to the role's database access
+// policy, creating the "Allow connect" statement if it doesn't exist.
+func addResourceToPolicy(ctx context.Context, iamClient awsiamface.IAMAPI, roleName, resourceID string) error {
+	doc, err := getPolicyDocument(ctx, iamClient, roleName)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(doc.Statement) == 0 {
+		doc.Statement = []policyStatement{{
+			Effect: "Allow",
+			Action: []string{"rds-db:connect", "redshift:GetClusterCredentials"},
+		}}
+	}
+	doc.Statement[0].Resource = appendUnique(doc.Statement[0].Resource, resourceID)
+	return trace.Wrap(putPolicyDocument(ctx, iamClient, roleName, doc))
+}
+
+// removeResourceFromPolicy removes the resource ID from the role's
+// database access policy.
+func removeResourceFromPolicy(ctx context.Context, iamClient awsiamface.IAMAPI, roleName, resourceID string) error {
+	doc, err := getPolicyDocument(ctx, iamClient, roleName)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(doc.Statement) == 0 {
+		return nil
+	}
+	doc.Statement[0].Resource = removeString(doc.Statement[0].Resource, resourceID)
+	return trace.Wrap(putPolicyDocument(ctx, iamClient, roleName, doc))
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, i := range items {
+		if i == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+func removeString(items []string, item string) []string {
+	out := items[:0]
+	for _, i := range items {
+		if i != item {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// decodePolicyDocument URL-decodes the policy document returned by the
+// IAM API.
+func decodePolicyDocument(encoded string) (string, error) {
+	decoded, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/aws/aws-sdk-go/service/redshift/redshiftiface"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+)
+
+// CloudClients is the subset of cloud API clients used by the database
+// access IAM configurator to discover and configure AWS and Azure
+// database resources.
+type CloudClients interface {
+	// GetAWSSTSClient returns an STS client for the given region.
+	GetAWSSTSClient(region string) (stsiface.STSAPI, error)
+	// GetAWSIAMClient returns an IAM client for the given region.
+	GetAWSIAMClient(region string) (iamiface.IAMAPI, error)
+	// GetAWSRDSClient returns an RDS client for the given region.
+	GetAWSRDSClient(region string) (rdsiface.RDSAPI, error)
+	// GetAWSRedshiftClient returns a Redshift client for the given region.
+	GetAWSRedshiftClient(region string) (redshiftiface.RedshiftAPI, error)
+	// GetAzureRoleAssignmentsClient returns an Azure role assignments
+	// client scoped to the given subscription.
+	GetAzureRoleAssignmentsClient(subscriptionID string) (AzureRoleAssignmentsClient, error)
+}
+
+// AzureRoleAssignmentsClient manages Azure RBAC role assignments. It's
+// implemented by the Azure SDK role assignments client and mocked in
+// tests.
+type AzureRoleAssignmentsClient interface {
+	// AssignRole assigns roleName to the configurator's managed identity
+	// on scope.
+	AssignRole(ctx context.Context, scope, roleName string) error
+	// RemoveRole removes roleName from the configurator's managed
+	// identity on scope.
+	RemoveRole(ctx context.Context, scope, roleName string) error
+}
+
+// TestCloudClients is a CloudClients implementation that returns fixed,
+// pre-configured clients, for use in tests.
+type TestCloudClients struct {
+	STS                  stsiface.STSAPI
+	IAM                  iamiface.IAMAPI
+	RDS                  rdsiface.RDSAPI
+	Redshift             redshiftiface.RedshiftAPI
+	AzureRoleAssignments AzureRoleAssignmentsClient
+}
+
+func (c *TestCloudClients) GetAWSSTSClient(string) (stsiface.STSAPI, error) {
+	return c.STS, nil
+}
+
+func (c *TestCloudClients) GetAWSIAMClient(string) (iamiface.IAMAPI, error) {
+	return c.IAM, nil
+}
+
+func (c *TestCloudClients) GetAWSRDSClient(string) (rdsiface.RDSAPI, error) {
+	return c.RDS, nil
+}
+
+func (c *TestCloudClients) GetAWSRedshiftClient(string) (redshiftiface.RedshiftAPI, error) {
+	return c.Redshift, nil
+}
+
+func (c *TestCloudClients) GetAzureRoleAssignmentsClient(string) (AzureRoleAssignmentsClient, error) {
+	return c.AzureRoleAssignments, nil
+}